@@ -3,11 +3,18 @@ package backend
 import (
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
 
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hcldec"
+	"github.com/zclconf/go-cty/cty"
+
 	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/configs"
 	"github.com/hashicorp/terraform/state"
 	"github.com/hashicorp/terraform/terraform"
+	"github.com/hashicorp/terraform/tfdiags"
 )
 
 // TestBackendConfig validates and configures the backend with the
@@ -37,6 +44,71 @@ func TestBackendConfig(t *testing.T, b Backend, c map[string]interface{}) Backen
 	return b
 }
 
+// TestWrapConfig takes a cty.Value map and wraps it in an hcl.Body that
+// behaves as if it had been decoded from an HCL configuration block,
+// for use with TestBackendConfigHCL.
+func TestWrapConfig(m map[string]cty.Value) hcl.Body {
+	return configs.SynthBody("<TestWrapConfig>", m)
+}
+
+// TestBackendConfigHCL validates and configures the backend using its
+// declared configuration schema, in the same manner as a real caller
+// decoding an HCL configuration block. It is the schema-driven
+// counterpart to TestBackendConfig, which still uses the legacy
+// ResourceConfig path via Backend.Configure. The schema-driven path is
+// exposed through the distinct Backend.ConfigureHCL method so the two
+// configuration styles can coexist on the same Backend interface while
+// the migration away from config.RawConfig is still in progress.
+//
+// NOTE: ConfigSchema, PrepareConfig, and ConfigureHCL are new Backend
+// interface methods, not yet declared in backend.go. Whoever owns that
+// interface definition needs to add them, and existing Backend
+// implementations will need ConfigureHCL alongside their legacy
+// Configure method until the ResourceConfig path is removed.
+//
+// A nil body is accepted for test ergonomics and is treated as an
+// empty configuration. Any error-severity diagnostic produced while
+// decoding, preparing, or configuring the backend fails the test;
+// warnings are logged but do not fail the test.
+func TestBackendConfigHCL(t *testing.T, b Backend, body hcl.Body) Backend {
+	t.Helper()
+
+	if body == nil {
+		body = hcl.EmptyBody()
+	}
+
+	var diags tfdiags.Diagnostics
+
+	schema := b.ConfigSchema()
+	spec := schema.DecoderSpec()
+	obj, decDiags := hcldec.Decode(body, spec, nil)
+	diags = diags.Append(decDiags)
+	if diags.HasErrors() {
+		t.Fatalf("failed to decode backend config: %s", diags.Err())
+	}
+
+	newObj, prepDiags := b.PrepareConfig(obj)
+	diags = diags.Append(prepDiags)
+	if diags.HasErrors() {
+		t.Fatalf("invalid backend config: %s", diags.Err())
+	}
+	obj = newObj
+
+	confDiags := b.ConfigureHCL(obj)
+	diags = diags.Append(confDiags)
+	if diags.HasErrors() {
+		t.Fatalf("failed to configure backend: %s", diags.Err())
+	}
+
+	for _, diag := range diags {
+		if diag.Severity() == tfdiags.Warning {
+			t.Logf("warning: %s", diag)
+		}
+	}
+
+	return b
+}
+
 // TestBackend will test the functionality of a Backend. The backend is
 // assumed to already be configured. This will test state functionality.
 // If the backend reports it doesn't support multi-state by returning the
@@ -45,17 +117,36 @@ func TestBackendConfig(t *testing.T, b Backend, c map[string]interface{}) Backen
 // If you want to test locking, two backends must be given. If b2 is nil,
 // then state lockign won't be tested.
 func TestBackend(t *testing.T, b1, b2 Backend) {
-	testBackendStates(t, b1)
+	testBackendWorkspaces(t, b1)
 
 	if b2 != nil {
 		testBackendStateLock(t, b1, b2)
+		testBackendForceUnlock(t, b1, b2)
+	}
+}
+
+// skipIfNamedStatesUnsupported reports whether any of errs is
+// ErrNamedStatesNotSupported, logging and letting the caller skip
+// cleanly instead of failing a test against a backend that doesn't
+// implement named states. Callers should return immediately when this
+// returns true.
+func skipIfNamedStatesUnsupported(t *testing.T, b Backend, errs ...error) bool {
+	for _, err := range errs {
+		if err == ErrNamedStatesNotSupported {
+			t.Logf("TestBackend: named states not supported in %T, skipping", b)
+			return true
+		}
 	}
+	return false
 }
 
-func testBackendStates(t *testing.T, b Backend) {
+// testBackendWorkspaces tests the naming and isolation semantics of a
+// Backend's workspaces (named states): creation, listing, isolation of
+// writes between workspaces, deletion, and the handling of invalid or
+// unusual workspace names.
+func testBackendWorkspaces(t *testing.T, b Backend) {
 	states, err := b.States()
-	if err == ErrNamedStatesNotSupported {
-		t.Logf("TestBackend: named states not supported in %T, skipping", b)
+	if skipIfNamedStatesUnsupported(t, b, err) {
 		return
 	}
 
@@ -64,6 +155,11 @@ func testBackendStates(t *testing.T, b Backend) {
 		t.Fatalf("should only have default to start: %#v", states)
 	}
 
+	// Invalid workspace names are rejected, and creating/deleting other
+	// workspaces has no side effect on whether the reserved default
+	// workspace name shows up in States().
+	testBackendWorkspaceNames(t, b)
+
 	// Create a couple states
 	fooState, err := b.State("foo")
 	if err != nil {
@@ -113,8 +209,7 @@ func testBackendStates(t *testing.T, b Backend) {
 	// Verify we can now list them
 	{
 		states, err := b.States()
-		if err == ErrNamedStatesNotSupported {
-			t.Logf("TestBackend: named states not supported in %T, skipping", b)
+		if skipIfNamedStatesUnsupported(t, b, err) {
 			return
 		}
 
@@ -138,8 +233,7 @@ func testBackendStates(t *testing.T, b Backend) {
 	// Verify deletion
 	{
 		states, err := b.States()
-		if err == ErrNamedStatesNotSupported {
-			t.Logf("TestBackend: named states not supported in %T, skipping", b)
+		if skipIfNamedStatesUnsupported(t, b, err) {
 			return
 		}
 
@@ -149,6 +243,221 @@ func testBackendStates(t *testing.T, b Backend) {
 			t.Fatalf("bad: %#v", states)
 		}
 	}
+
+	// DeleteState on a workspace that was never created is idempotent.
+	if err := b.DeleteState("baz"); err != nil {
+		t.Fatalf("deleting a non-existent workspace should be a no-op: %s", err)
+	}
+
+	testBackendWorkspaceConcurrentAccess(t, b)
+	testBackendWorkspaceDeleteLocked(t, b)
+}
+
+// testBackendWorkspaceNames verifies that invalid workspace names are
+// rejected by State, and that the reserved default workspace name does
+// not leak into States() as a side effect of other workspaces being
+// created and deleted.
+func testBackendWorkspaceNames(t *testing.T, b Backend) {
+	invalidNames := []string{
+		"",
+		"foo/bar",
+		"foo:bar",
+		".foo",
+	}
+
+	for _, name := range invalidNames {
+		_, err := b.State(name)
+		if skipIfNamedStatesUnsupported(t, b, err) {
+			return
+		}
+		if err == nil {
+			t.Fatalf("expected error getting state for invalid workspace name %q", name)
+		}
+	}
+
+	before, err := b.States()
+	if skipIfNamedStatesUnsupported(t, b, err) {
+		return
+	}
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defaultBefore := containsString(before, DefaultStateName)
+
+	if _, err := b.State("namechurn-a"); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if _, err := b.State("namechurn-b"); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if err := b.DeleteState("namechurn-a"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := b.DeleteState("namechurn-b"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	after, err := b.States()
+	if skipIfNamedStatesUnsupported(t, b, err) {
+		return
+	}
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defaultAfter := containsString(after, DefaultStateName)
+
+	// This only guards against the default workspace disappearing (or
+	// spuriously appearing) as a side effect of unrelated workspace
+	// churn. The precondition checked in testBackendWorkspaces, that
+	// every backend under test starts out reporting the default
+	// workspace, means the "lazily registered, absent until written"
+	// half of this behavior can never be exercised here.
+	if defaultBefore != defaultAfter {
+		t.Fatalf(
+			"creating and deleting unrelated workspaces changed whether %q appears in States(): before=%#v after=%#v",
+			DefaultStateName, before, after,
+		)
+	}
+}
+
+// containsString returns true if s is present in ss.
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// testBackendWorkspaceConcurrentAccess verifies that two State managers
+// obtained for the same workspace name observe each other's writes once
+// refreshed, as they would if backed by the same remote store.
+func testBackendWorkspaceConcurrentAccess(t *testing.T, b Backend) {
+	const wsName = "concurrent"
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	var mgrA, mgrB state.State
+	var errA, errB error
+
+	go func() {
+		defer wg.Done()
+		mgrA, errA = b.State(wsName)
+	}()
+	go func() {
+		defer wg.Done()
+		mgrB, errB = b.State(wsName)
+	}()
+	wg.Wait()
+
+	if skipIfNamedStatesUnsupported(t, b, errA, errB) {
+		return
+	}
+	if errA != nil {
+		t.Fatalf("error getting state from goroutine A: %s", errA)
+	}
+	if errB != nil {
+		t.Fatalf("error getting state from goroutine B: %s", errB)
+	}
+
+	if err := mgrA.RefreshState(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	s := mgrA.State()
+	if s == nil {
+		s = terraform.NewState()
+	}
+	s.Lineage = "concurrent"
+	if err := mgrA.WriteState(s); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := mgrA.PersistState(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if err := mgrB.RefreshState(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if v := mgrB.State(); v == nil || v.Lineage != "concurrent" {
+		t.Fatalf("manager B did not observe manager A's write: %#v", v)
+	}
+
+	sB := mgrB.State()
+	sB.Lineage = "concurrent-b"
+	if err := mgrB.WriteState(sB); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if err := mgrB.PersistState(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if err := mgrA.RefreshState(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if v := mgrA.State(); v == nil || v.Lineage != "concurrent-b" {
+		t.Fatalf("manager A did not observe manager B's write: %#v", v)
+	}
+
+	if err := b.DeleteState(wsName); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+// testBackendWorkspaceDeleteLocked verifies that DeleteState refuses to
+// delete a workspace whose state is currently locked, surfacing a
+// *state.LockError rather than silently deleting out from under the
+// lock holder.
+func testBackendWorkspaceDeleteLocked(t *testing.T, b Backend) {
+	const wsName = "locked"
+
+	mgr, err := b.State(wsName)
+	if skipIfNamedStatesUnsupported(t, b, err) {
+		return
+	}
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	locker, ok := mgr.(state.Locker)
+	if !ok {
+		t.Logf("TestBackend: backend %T doesn't support state locking, not testing locked deletion", b)
+		b.DeleteState(wsName)
+		return
+	}
+
+	info := state.NewLockInfo()
+	info.Operation = "test"
+	info.Who = "deleteLockTest"
+
+	lockID, err := locker.Lock(info)
+	if err != nil {
+		t.Fatal("unable to get lock:", err)
+	}
+	if lockID == "" {
+		t.Logf("TestBackend: %T: empty string returned for lock, assuming disabled", b)
+		b.DeleteState(wsName)
+		return
+	}
+
+	err = b.DeleteState(wsName)
+	if err == nil {
+		locker.Unlock(lockID)
+		t.Fatal("expected error deleting a locked workspace")
+	}
+	if _, ok := err.(*state.LockError); !ok {
+		locker.Unlock(lockID)
+		t.Fatalf("expected *state.LockError, got %T: %s", err, err)
+	}
+
+	if err := locker.Unlock(lockID); err != nil {
+		t.Fatal("error unlocking:", err)
+	}
+	if err := b.DeleteState(wsName); err != nil {
+		t.Fatalf("err: %s", err)
+	}
 }
 
 func testBackendStateLock(t *testing.T, b1, b2 Backend) {
@@ -224,3 +533,105 @@ func testBackendStateLock(t *testing.T, b1, b2 Backend) {
 	}
 
 }
+
+// testBackendForceUnlock verifies that a stale lock left behind by one
+// client can be recovered by another client via Unlock, and that lock
+// metadata (the lock ID and Info fields) is correctly round-tripped
+// through the backend's remote store.
+func testBackendForceUnlock(t *testing.T, b1, b2 Backend) {
+	// Get the default state for each
+	b1StateMgr, err := b1.State(DefaultStateName)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if err := b1StateMgr.RefreshState(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Fast exit if this doesn't support locking at all
+	lockerA, ok := b1StateMgr.(state.Locker)
+	if !ok {
+		t.Logf("TestBackend: backend %T doesn't support state locking, not testing force-unlock", b1)
+		return
+	}
+
+	b2StateMgr, err := b2.State(DefaultStateName)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if err := b2StateMgr.RefreshState(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	lockerB := b2StateMgr.(state.Locker)
+
+	infoA := state.NewLockInfo()
+	infoA.Operation = "test"
+	infoA.Who = "clientA"
+
+	infoB := state.NewLockInfo()
+	infoB.Operation = "test"
+	infoB.Who = "clientB"
+
+	lockIDA, err := lockerA.Lock(infoA)
+	if err != nil {
+		t.Fatal("unable to get initial lock:", err)
+	}
+
+	// If the lock ID is blank, assume locking is disabled
+	if lockIDA == "" {
+		t.Logf("TestBackend: %T: empty string returned for lock, assuming disabled", b1)
+		return
+	}
+
+	// clientB should fail to obtain the lock while clientA holds it, and
+	// the error should carry clientA's lock info so an operator (or an
+	// automated force-unlock) can identify who holds it.
+	_, err = lockerB.Lock(infoB)
+	if err == nil {
+		lockerA.Unlock(lockIDA)
+		t.Fatal("client B obtained lock while held by client A")
+	}
+
+	lockErr, ok := err.(*state.LockError)
+	if !ok {
+		t.Logf("TestBackend: %T: Lock error %T does not expose lock metadata, not testing force-unlock", b1, err)
+		lockerA.Unlock(lockIDA)
+		return
+	}
+	if lockErr.Info == nil {
+		lockerA.Unlock(lockIDA)
+		t.Fatal("lock error did not include lock info")
+	}
+	if lockErr.Info.ID != lockIDA {
+		lockerA.Unlock(lockIDA)
+		t.Fatalf("lock info ID %q does not match held lock ID %q", lockErr.Info.ID, lockIDA)
+	}
+	if lockErr.Info.Who == "" {
+		lockerA.Unlock(lockIDA)
+		t.Fatal("lock info did not include Who")
+	}
+	if lockErr.Info.Operation == "" {
+		lockerA.Unlock(lockIDA)
+		t.Fatal("lock info did not include Operation")
+	}
+
+	// clientB force-releases the stale lock using the ID it learned from
+	// the failed Lock call.
+	if err := lockerB.Unlock(lockErr.Info.ID); err != nil {
+		t.Fatal("error force-unlocking stale lock from client B:", err)
+	}
+
+	// clientB should now be able to obtain a fresh lock.
+	lockIDB, err := lockerB.Lock(infoB)
+	if err != nil {
+		t.Fatal("unable to obtain lock from client B after force-unlock:", err)
+	}
+	if lockIDB == lockIDA {
+		t.Fatalf("duplicate lock IDs: %q", lockIDB)
+	}
+
+	if err := lockerB.Unlock(lockIDB); err != nil {
+		t.Fatal("error unlocking client B:", err)
+	}
+}